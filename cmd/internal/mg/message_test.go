@@ -0,0 +1,162 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+
+	"rsc.io/mailgun/cmd/internal/mg/mime"
+)
+
+// render runs msg through the same renderTemplates+buildMIME steps
+// Mail does, then parses the result with the mg/mime package, so
+// tests can assert on the decoded message rather than raw MIME text.
+func render(t *testing.T, msg *Message) *mime.Message {
+	t.Helper()
+	if err := renderTemplates(msg); err != nil {
+		t.Fatalf("renderTemplates: %v", err)
+	}
+	r, err := buildMIME(msg)
+	if err != nil {
+		t.Fatalf("buildMIME: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading rendered MIME: %v", err)
+	}
+	if !strings.Contains(string(data), "MIME-Version: 1.0") {
+		t.Errorf("rendered message is missing MIME-Version header:\n%s", data)
+	}
+	parsed, err := mime.Parse(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatalf("mime.Parse: %v\n%s", err, data)
+	}
+	return parsed
+}
+
+func writeTempFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("writing %s: %v", path, err)
+	}
+	return path
+}
+
+func baseMessage(t *testing.T) *Message {
+	return &Message{
+		From:    mustAddr(t, "from@example.com"),
+		To:      []*mail.Address{mustAddr(t, "to@example.com")},
+		Subject: "hello",
+		Body:    "plain text body",
+	}
+}
+
+func TestBuildMIMEPlainText(t *testing.T) {
+	parsed := render(t, baseMessage(t))
+	if parsed.TextBody != "plain text body" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "plain text body")
+	}
+	if parsed.HTMLBody != "" {
+		t.Errorf("HTMLBody = %q, want empty", parsed.HTMLBody)
+	}
+}
+
+func TestBuildMIMEHTMLAlternative(t *testing.T) {
+	msg := baseMessage(t)
+	msg.HTMLBody = "<p>plain text body</p>"
+	parsed := render(t, msg)
+
+	if parsed.TextBody != "plain text body" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "plain text body")
+	}
+	if parsed.HTMLBody != "<p>plain text body</p>" {
+		t.Errorf("HTMLBody = %q, want %q", parsed.HTMLBody, "<p>plain text body</p>")
+	}
+}
+
+func TestBuildMIMEInlineImage(t *testing.T) {
+	imgPath := writeTempFile(t, "logo.png", "fake png bytes")
+
+	msg := baseMessage(t)
+	msg.HTMLBody = `<img src="cid:logo">`
+	msg.Inlines = []InlineFile{{CID: "logo", File: imgPath}}
+	parsed := render(t, msg)
+
+	if len(parsed.Inlines) != 1 {
+		t.Fatalf("Inlines = %v, want 1 entry", parsed.Inlines)
+	}
+	in := parsed.Inlines[0]
+	if in.CID != "logo" {
+		t.Errorf("Inline CID = %q, want %q", in.CID, "logo")
+	}
+	if string(in.Data) != "fake png bytes" {
+		t.Errorf("Inline Data = %q, want %q", in.Data, "fake png bytes")
+	}
+}
+
+func TestBuildMIMEAttachments(t *testing.T) {
+	filePath := writeTempFile(t, "report.txt", "report contents")
+
+	msg := baseMessage(t)
+	msg.Attachments = []string{filePath}
+	parsed := render(t, msg)
+
+	if parsed.TextBody != "plain text body" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "plain text body")
+	}
+	if len(parsed.Attachments) != 1 {
+		t.Fatalf("Attachments = %v, want 1 entry", parsed.Attachments)
+	}
+	a := parsed.Attachments[0]
+	if a.Filename != "report.txt" {
+		t.Errorf("Attachment Filename = %q, want %q", a.Filename, "report.txt")
+	}
+	if string(a.Data) != "report contents" {
+		t.Errorf("Attachment Data = %q, want %q", a.Data, "report contents")
+	}
+}
+
+func TestBuildMIMEHTMLInlineAndAttachmentTogether(t *testing.T) {
+	imgPath := writeTempFile(t, "logo.png", "fake png bytes")
+	filePath := writeTempFile(t, "report.txt", "report contents")
+
+	msg := baseMessage(t)
+	msg.HTMLBody = `<img src="cid:logo">`
+	msg.Inlines = []InlineFile{{CID: "logo", File: imgPath}}
+	msg.Attachments = []string{filePath}
+	parsed := render(t, msg)
+
+	if parsed.HTMLBody != `<img src="cid:logo">` {
+		t.Errorf("HTMLBody = %q, want %q", parsed.HTMLBody, `<img src="cid:logo">`)
+	}
+	if len(parsed.Inlines) != 1 || string(parsed.Inlines[0].Data) != "fake png bytes" {
+		t.Errorf("Inlines = %v, want one part with the logo bytes", parsed.Inlines)
+	}
+	if len(parsed.Attachments) != 1 || parsed.Attachments[0].Filename != "report.txt" {
+		t.Errorf("Attachments = %v, want one report.txt entry", parsed.Attachments)
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	msg := baseMessage(t)
+	msg.TextTemplate = texttemplate.Must(texttemplate.New("t").Parse("Hello, {{.Name}}!"))
+	msg.HTMLTemplate = htmltemplate.Must(htmltemplate.New("h").Parse("<p>Hello, {{.Name}}!</p>"))
+	msg.Data = struct{ Name string }{"World"}
+
+	parsed := render(t, msg)
+	if parsed.TextBody != "Hello, World!" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "Hello, World!")
+	}
+	if parsed.HTMLBody != "<p>Hello, World!</p>" {
+		t.Errorf("HTMLBody = %q, want %q", parsed.HTMLBody, "<p>Hello, World!</p>")
+	}
+}
@@ -7,19 +7,30 @@
 package mg
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	htmltemplate "html/template"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/mail"
+	"net/smtp"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	texttemplate "text/template"
 )
 
 var (
@@ -73,13 +84,44 @@ func Die(err error) {
 	os.Exit(2)
 }
 
+// parseKey parses the contents of a mailgun key file or $MAILGUNKEY value.
+// The usual form is "<domain> api:key-<hexstring>", selecting delivery
+// through the Mailgun HTTP API. A line of the form
+// "smtp host:port user pass [starttls|tls]" selects delivery through
+// plain SMTP submission instead, for hosts that must relay through a
+// corporate smarthost or a self-hosted mail server.
 func parseKey(src, key string) {
 	f := strings.Fields(key)
+	if len(f) > 0 && f[0] == "smtp" {
+		parseSMTPKey(src, f)
+		return
+	}
 	if len(f) != 2 || !strings.Contains(f[0], ".") || !strings.HasPrefix(f[1], "api:key-") {
 		Die(fmt.Errorf("malformed mailgun API key in %s", src))
 	}
 	Domain = f[0]
 	APIKey = strings.TrimPrefix(f[1], "api:")
+	activeTransport = mailgunAPI{}
+}
+
+func parseSMTPKey(src string, f []string) {
+	if len(f) != 4 && len(f) != 5 {
+		Die(fmt.Errorf("malformed smtp config in %s", src))
+	}
+	t := &smtpTransport{addr: f[1], user: f[2], pass: f[3]}
+	if len(f) == 5 {
+		switch f[4] {
+		case "starttls", "tls":
+			t.security = f[4]
+		default:
+			Die(fmt.Errorf("malformed smtp config in %s: unknown mode %q", src, f[4]))
+		}
+	}
+	Domain = f[1]
+	if i := strings.LastIndex(Domain, ":"); i >= 0 {
+		Domain = Domain[:i]
+	}
+	activeTransport = t
 }
 
 func ParseAddress(addr string) (*mail.Address, error) {
@@ -141,8 +183,47 @@ type Message struct {
 	CC          []*mail.Address
 	BCC         []*mail.Address
 	Subject     string
-	Body        string   `json:"-"`
+	Body        string `json:"-"`
+	HTMLBody    string `json:"-"` // if set, sent as a text/html alternative to Body
+	Inlines     []InlineFile
 	Attachments []string // file names
+
+	// TextTemplate and HTMLTemplate, if set, are executed with Data
+	// at send time to produce Body and HTMLBody respectively,
+	// mirroring go-mail's SetBodyTextTemplate/SetBodyHTMLTemplate.
+	TextTemplate *texttemplate.Template
+	HTMLTemplate *htmltemplate.Template
+	Data         interface{}
+
+	// Middlewares run, in order, over the Message itself, after
+	// templates are rendered and before buildMIME runs.
+	Middlewares []Middleware
+
+	// MIMEMiddlewares run, in order, over the fully rendered MIME
+	// message before it is handed to the Transport. PGPSign and
+	// PGPEncrypt are the built-in implementations.
+	MIMEMiddlewares []MIMEMiddleware
+}
+
+// A Middleware transforms a Message before it is rendered to MIME.
+type Middleware interface {
+	Apply(msg *Message) error
+}
+
+// A MIMEMiddleware transforms an already-rendered MIME message before
+// it is handed to a Transport, e.g. to sign or encrypt it. hdr holds
+// the message's top-level headers; a middleware that changes the
+// structure of body (wrapping it in a new multipart envelope, say)
+// must update hdr's Content-Type to match what it returns.
+type MIMEMiddleware interface {
+	ApplyMIME(hdr textproto.MIMEHeader, body io.Reader) (io.Reader, error)
+}
+
+// An InlineFile is an image or other resource referenced from
+// Message.HTMLBody by a "cid:" URL, e.g. <img src="cid:logo">.
+type InlineFile struct {
+	CID  string
+	File string
 }
 
 // Allow implicit local domain in addresses.
@@ -158,58 +239,252 @@ func FixLocalAddrs(list []*mail.Address) {
 	}
 }
 
+// A Transport delivers a MIME-encoded message to its envelope
+// recipients. mailgunAPI submits through the Mailgun HTTP API;
+// smtpTransport relays through a plain SMTP submission server.
+// The active transport is selected by parseKey based on the
+// contents of the mailgun key file.
+type Transport interface {
+	Send(from *mail.Address, to []*mail.Address, mime io.Reader) error
+}
+
+var activeTransport Transport = mailgunAPI{}
+
+// A RetryableError is returned by a Transport when delivery failed in
+// a way that is likely transient: a network error, a 5xx/429
+// response from the Mailgun API, or a 4yz reply or failed TLS setup
+// from an SMTP server. deliver spools messages that fail
+// this way instead of giving up on them.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string { return e.Err.Error() }
+func (e *RetryableError) Unwrap() error { return e.Err }
+
+func IsRetryable(err error) bool {
+	var re *RetryableError
+	return errors.As(err, &re)
+}
+
 func Mail(msg *Message) {
 	FixLocalAddr(msg.From)
 	FixLocalAddrs(msg.To)
 	FixLocalAddrs(msg.CC)
 	FixLocalAddrs(msg.BCC)
 
+	if err := renderTemplates(msg); err != nil {
+		Die(err)
+	}
+	for _, mw := range msg.Middlewares {
+		if err := mw.Apply(msg); err != nil {
+			Die(fmt.Errorf("applying middleware: %v", err))
+		}
+	}
+
+	r, err := buildMIME(msg)
+	if err != nil {
+		Die(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		Die(err)
+	}
+	data, err = applyMIMEMiddlewares(data, msg.MIMEMiddlewares)
+	if err != nil {
+		Die(err)
+	}
+
 	var allTo []*mail.Address
 	allTo = append(allTo, msg.To...)
 	allTo = append(allTo, msg.CC...)
 	allTo = append(allTo, msg.BCC...)
 
-	w, end := startPost(msg.From, allTo, "messages")
-	check(w.WriteField("from", msg.From.String()))
+	deliver(msg.From, allTo, data)
+}
+
+// renderTemplates executes msg.TextTemplate and msg.HTMLTemplate, if
+// set, against msg.Data, filling in Body and HTMLBody respectively.
+func renderTemplates(msg *Message) error {
+	if msg.TextTemplate != nil {
+		var buf bytes.Buffer
+		if err := msg.TextTemplate.Execute(&buf, msg.Data); err != nil {
+			return fmt.Errorf("rendering text template: %v", err)
+		}
+		msg.Body = buf.String()
+	}
+	if msg.HTMLTemplate != nil {
+		var buf bytes.Buffer
+		if err := msg.HTMLTemplate.Execute(&buf, msg.Data); err != nil {
+			return fmt.Errorf("rendering html template: %v", err)
+		}
+		msg.HTMLBody = buf.String()
+	}
+	return nil
+}
+
+// buildMIME renders msg as an RFC 5322 message: headers followed by a
+// body whose structure depends on what msg sets. With only Body, the
+// body is a single text/plain part. Adding HTMLBody wraps that in
+// multipart/alternative; adding Inlines further wraps HTMLBody in
+// multipart/related. Adding Attachments wraps the whole body in
+// multipart/mixed alongside the attachment parts. buildMIME does not
+// include a Bcc header, so callers that need to deliver to BCC
+// recipients must pass them to the Transport separately from the
+// rendered message.
+func buildMIME(msg *Message) (io.Reader, error) {
+	var hdr bytes.Buffer
+	fmt.Fprintf(&hdr, "From: %s\n", msg.From.String())
 	for _, a := range msg.To {
-		check(w.WriteField("to", a.String()))
+		fmt.Fprintf(&hdr, "To: %s\n", a.String())
 	}
 	for _, a := range msg.CC {
-		check(w.WriteField("cc", a.String()))
-	}
-	for _, a := range msg.BCC {
-		check(w.WriteField("bcc", a.String()))
+		fmt.Fprintf(&hdr, "Cc: %s\n", a.String())
 	}
 	if msg.Subject != "" {
-		check(w.WriteField("subject", msg.Subject))
+		fmt.Fprintf(&hdr, "Subject: %s\n", msg.Subject)
+	}
+	fmt.Fprintf(&hdr, "MIME-Version: 1.0\n")
+
+	bodyType, body, err := buildBody(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg.Attachments) == 0 {
+		fmt.Fprintf(&hdr, "Content-Type: %s\n\n", bodyType)
+		return io.MultiReader(&hdr, body), nil
+	}
+
+	var mixed bytes.Buffer
+	w := multipart.NewWriter(&mixed)
+	fmt.Fprintf(&hdr, "Content-Type: multipart/mixed; boundary=%s\n\n", w.Boundary())
+
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {bodyType}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, body); err != nil {
+		return nil, err
 	}
-	check(w.WriteField("text", msg.Body))
 
 	for _, file := range msg.Attachments {
-		ww, err := w.CreateFormFile("attachment", filepath.Base(file))
-		check(err)
-		f, err := os.Open(file)
-		if err != nil {
-			Die(fmt.Errorf("attaching file: %v", err))
+		if err := attachFile(w, "attachment", file, filepath.Base(file), ""); err != nil {
+			return nil, err
 		}
-		if _, err := io.Copy(ww, f); err != nil {
-			Die(fmt.Errorf("attaching file: %v", err))
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return io.MultiReader(&hdr, &mixed), nil
+}
+
+// buildBody renders msg's Body, alternated with its HTMLBody if set,
+// and returns the Content-Type header value and serialized body for
+// that part of the message.
+func buildBody(msg *Message) (contentType string, body io.Reader, err error) {
+	if msg.HTMLBody == "" {
+		return "text/plain; charset=utf-8", strings.NewReader(msg.Body), nil
+	}
+
+	htmlType, htmlBody, err := buildHTMLPart(msg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	text, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return "", nil, err
+	}
+	io.WriteString(text, msg.Body)
+
+	html, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {htmlType}})
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := io.Copy(html, htmlBody); err != nil {
+		return "", nil, err
+	}
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("multipart/alternative; boundary=%s", w.Boundary()), &buf, nil
+}
+
+// buildHTMLPart renders msg's HTMLBody, wrapping it in
+// multipart/related with its Inlines if there are any.
+func buildHTMLPart(msg *Message) (contentType string, body io.Reader, err error) {
+	if len(msg.Inlines) == 0 {
+		return "text/html; charset=utf-8", strings.NewReader(msg.HTMLBody), nil
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	html, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}})
+	if err != nil {
+		return "", nil, err
+	}
+	io.WriteString(html, msg.HTMLBody)
+
+	for _, in := range msg.Inlines {
+		if err := attachFile(w, "inline", in.File, filepath.Base(in.File), in.CID); err != nil {
+			return "", nil, err
 		}
-		f.Close()
 	}
-	check(w.Close())
-	end()
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("multipart/related; boundary=%s", w.Boundary()), &buf, nil
 }
 
-func startPost(from *mail.Address, to []*mail.Address, endpoint string) (w *multipart.Writer, end func()) {
+// attachFile reads file and writes it to w as a base64-encoded part
+// with the given Content-Disposition (e.g. "attachment" or "inline")
+// and filename. If cid is non-empty, the part also gets a Content-ID
+// header so an HTML body can reference it as cid:cid.
+func attachFile(w *multipart.Writer, disposition, file, filename, cid string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("attaching file: %v", err)
+	}
+	defer f.Close()
+
+	header := textproto.MIMEHeader{
+		"Content-Type":              {"application/octet-stream"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("%s; filename=%q", disposition, filename)},
+	}
+	if cid != "" {
+		header.Set("Content-ID", "<"+cid+">")
+	}
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, part)
+	if _, err := io.Copy(enc, f); err != nil {
+		return fmt.Errorf("attaching file: %v", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("attaching file: %v", err)
+	}
+	return nil
+}
+
+// mailgunAPIBase is the root of the Mailgun API, overridden by tests
+// to point at a fake HTTP server instead of the real service.
+var mailgunAPIBase = "https://api.mailgun.net/v3/"
+
+func startPost(from *mail.Address, to []*mail.Address, endpoint string) (w *multipart.Writer, end func() error) {
 	pr, pw := io.Pipe()
 	w = multipart.NewWriter(pw)
-	endpoint = "https://api.mailgun.net/v3/" + Domain + "/" + endpoint
-	c := make(chan int)
+	endpoint = mailgunAPIBase + Domain + "/" + endpoint
+	c := make(chan error, 1)
 	go runPost(from, to, endpoint, w.FormDataContentType(), pr, c)
-	end = func() {
+	end = func() error {
 		pw.Close()
-		<-c
+		return <-c
 	}
 	return w, end
 }
@@ -225,17 +500,21 @@ func (c *countingReader) Read(b []byte) (int, error) {
 	return n, err
 }
 
-func runPost(from *mail.Address, to []*mail.Address, endpoint, bodytype string, body io.Reader, c chan int) {
+func runPost(from *mail.Address, to []*mail.Address, endpoint, bodytype string, body io.Reader, c chan error) {
 	cr := &countingReader{r: body}
 	req, err := http.NewRequest("POST", endpoint, cr)
-	check(err)
+	if err != nil {
+		c <- fmt.Errorf("creating mailgun API request: %v", err)
+		return
+	}
 	req.Header.Set("Content-Type", bodytype)
 	req.SetBasicAuth("api", APIKey)
 
 	if DebugHTTP {
 		dump, err := httputil.DumpRequest(req, true)
 		if err != nil {
-			Die(fmt.Errorf("dumping request: %v", err))
+			c <- fmt.Errorf("dumping request: %v", err)
+			return
 		}
 		os.Stderr.Write(dump)
 	}
@@ -243,29 +522,37 @@ func runPost(from *mail.Address, to []*mail.Address, endpoint, bodytype string,
 	if DisableMail {
 		fmt.Fprintf(os.Stderr, "not sending mail (disabled)\n")
 		io.Copy(ioutil.Discard, body)
-		c <- 1
+		c <- nil
 		return
 	}
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		Die(fmt.Errorf("sending mail: %v", err))
+		c <- &RetryableError{fmt.Errorf("sending mail: %v", err)}
+		return
 	}
 
 	if DebugHTTP {
 		dump, err := httputil.DumpResponse(resp, true)
 		if err != nil {
-			Die(fmt.Errorf("dumping response: %v", err))
+			c <- fmt.Errorf("dumping response: %v", err)
+			return
 		}
 		os.Stderr.Write(dump)
 	}
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode != 200 {
-		Die(fmt.Errorf("sending mail: %v\n%s", resp.Status, data))
+		sendErr := fmt.Errorf("sending mail: %v\n%s", resp.Status, data)
+		if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+			sendErr = &RetryableError{sendErr}
+		}
+		c <- sendErr
+		return
 	}
 	if err != nil {
-		Die(fmt.Errorf("sending mail: %v\n%s", err, data))
+		c <- fmt.Errorf("sending mail: %v\n%s", err, data)
+		return
 	}
 
 	var mailResp struct {
@@ -273,7 +560,8 @@ func runPost(from *mail.Address, to []*mail.Address, endpoint, bodytype string,
 		ID      string `json:"id"`
 	}
 	if err := json.Unmarshal(data, &mailResp); err != nil {
-		Die(fmt.Errorf("sending mail: invalid JSON response: %v\n%s", err, data))
+		c <- fmt.Errorf("sending mail: invalid JSON response: %v\n%s", err, data)
+		return
 	}
 	var compact bytes.Buffer
 	json.Compact(&compact, data)
@@ -281,28 +569,257 @@ func runPost(from *mail.Address, to []*mail.Address, endpoint, bodytype string,
 	if IsTTY || Verbose {
 		fmt.Fprintf(os.Stderr, "mailgun: %s\n", mailResp.Message)
 	}
-	c <- 1
+	c <- nil
+}
+
+// mailgunAPI delivers mail through the Mailgun HTTP API, posting the
+// rendered MIME message to the messages.mime endpoint.
+type mailgunAPI struct{}
+
+func (mailgunAPI) Send(from *mail.Address, to []*mail.Address, mime io.Reader) error {
+	w, end := startPost(from, to, "messages.mime")
+	for _, a := range to {
+		if err := w.WriteField("to", a.String()); err != nil {
+			return fmt.Errorf("creating mailgun API request: %v", err)
+		}
+	}
+	ww, err := w.CreateFormFile("message", "mime.msg")
+	if err != nil {
+		return fmt.Errorf("creating mailgun API request: %v", err)
+	}
+	if _, err := io.Copy(ww, mime); err != nil {
+		return fmt.Errorf("creating mailgun API request: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("creating mailgun API request: %v", err)
+	}
+	return end()
+}
+
+// smtpTransport delivers mail via a plain SMTP submission server,
+// for hosts that must relay through a corporate smarthost or a
+// self-hosted mail server instead of the Mailgun API.
+type smtpTransport struct {
+	addr     string // host:port
+	user     string
+	pass     string
+	security string // "", "starttls", or "tls"
+}
+
+// smtpRootCAs overrides the system root pool used to verify the TLS
+// and STARTTLS connections above. It is nil (use the system pool) in
+// production; tests set it to trust a fake server's certificate.
+var smtpRootCAs *x509.CertPool
+
+func smtpTLSConfig(host string) *tls.Config {
+	return &tls.Config{ServerName: host, RootCAs: smtpRootCAs}
 }
-func check(err error) {
+
+func (t *smtpTransport) Send(from *mail.Address, to []*mail.Address, mime io.Reader) error {
+	data, err := ioutil.ReadAll(mime)
+	if err != nil {
+		return fmt.Errorf("smtp: reading message: %v", err)
+	}
+
+	host, _, err := net.SplitHostPort(t.addr)
+	if err != nil {
+		return fmt.Errorf("smtp: bad address %q: %v", t.addr, err)
+	}
+
+	var c *smtp.Client
+	if t.security == "tls" {
+		conn, err := tls.Dial("tcp", t.addr, smtpTLSConfig(host))
+		if err != nil {
+			return &RetryableError{fmt.Errorf("smtp: dialing %s: %v", t.addr, err)}
+		}
+		c, err = smtp.NewClient(conn, host)
+		if err != nil {
+			return &RetryableError{fmt.Errorf("smtp: %v", err)}
+		}
+	} else {
+		c, err = smtp.Dial(t.addr)
+		if err != nil {
+			return &RetryableError{fmt.Errorf("smtp: dialing %s: %v", t.addr, err)}
+		}
+		if t.security == "starttls" {
+			if ok, _ := c.Extension("STARTTLS"); !ok {
+				return fmt.Errorf("smtp: server does not support STARTTLS")
+			}
+			if err := c.StartTLS(smtpTLSConfig(host)); err != nil {
+				return &RetryableError{fmt.Errorf("smtp: STARTTLS: %v", err)}
+			}
+		}
+	}
+	defer c.Close()
+
+	if t.user != "" {
+		if ok, authParam := c.Extension("AUTH"); ok {
+			var auth smtp.Auth
+			switch {
+			case strings.Contains(authParam, "PLAIN"):
+				auth = smtp.PlainAuth("", t.user, t.pass, host)
+			case strings.Contains(authParam, "LOGIN"):
+				auth = &loginAuth{t.user, t.pass}
+			default:
+				return fmt.Errorf("smtp: server offers no supported auth mechanism (%s)", authParam)
+			}
+			if err := c.Auth(auth); err != nil {
+				return wrapSMTPErr(err, "authenticating")
+			}
+		}
+	}
+
+	if err := c.Mail(from.Address); err != nil {
+		return wrapSMTPErr(err, "MAIL FROM")
+	}
+	for _, a := range to {
+		if err := c.Rcpt(a.Address); err != nil {
+			return wrapSMTPErr(err, fmt.Sprintf("RCPT TO %s", a.Address))
+		}
+	}
+	w, err := c.Data()
 	if err != nil {
-		Die(fmt.Errorf("creating mailgun API request: %v", err))
+		return wrapSMTPErr(err, "DATA")
 	}
+	if _, err := w.Write(data); err != nil {
+		return wrapSMTPErr(err, "writing message")
+	}
+	if err := w.Close(); err != nil {
+		return wrapSMTPErr(err, "closing message")
+	}
+	return c.Quit()
+}
+
+// wrapSMTPErr annotates err with step and, if the SMTP server
+// reported a 4yz transient negative reply (or the underlying error is
+// a network error), marks it as a RetryableError.
+func wrapSMTPErr(err error, step string) error {
+	wrapped := fmt.Errorf("smtp: %s: %v", step, err)
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) && tpErr.Code >= 400 && tpErr.Code < 500 {
+		return &RetryableError{wrapped}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &RetryableError{wrapped}
+	}
+	return wrapped
+}
+
+// loginAuth implements the AUTH LOGIN mechanism, which net/smtp does
+// not provide but many SMTP smarthosts require instead of, or in
+// addition to, PLAIN.
+type loginAuth struct {
+	user, pass string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(string(fromServer)) {
+	case "username:":
+		return []byte(a.user), nil
+	case "password:":
+		return []byte(a.pass), nil
+	}
+	return nil, fmt.Errorf("smtp: unexpected LOGIN challenge %q", fromServer)
 }
 
-func MailMIME(from *mail.Address, to []*mail.Address, mime io.Reader) {
+func MailMIME(from *mail.Address, to []*mail.Address, mime io.Reader, mws ...MIMEMiddleware) {
 	FixLocalAddr(from)
 	FixLocalAddrs(to)
 
-	w, end := startPost(from, to, "messages.mime")
-	for _, a := range to {
-		check(w.WriteField("to", a.String()))
+	data, err := ioutil.ReadAll(mime)
+	if err != nil {
+		Die(fmt.Errorf("reading message: %v", err))
 	}
-	ww, err := w.CreateFormFile("message", "mime.msg")
-	check(err)
-	_, err = io.Copy(ww, mime)
-	check(err)
-	check(w.Close())
-	end()
+	data, err = applyMIMEMiddlewares(data, mws)
+	if err != nil {
+		Die(err)
+	}
+	deliver(from, to, data)
+}
+
+// applyMIMEMiddlewares runs each of mws over data's body in turn,
+// passing along data's top-level headers so a middleware can update
+// Content-Type to reflect a new body structure.
+func applyMIMEMiddlewares(data []byte, mws []MIMEMiddleware) ([]byte, error) {
+	if len(mws) == 0 {
+		return data, nil
+	}
+	hdr, body, err := splitMIME(data)
+	if err != nil {
+		return nil, err
+	}
+	r := io.Reader(bytes.NewReader(body))
+	for _, mw := range mws {
+		r, err = mw.ApplyMIME(hdr, r)
+		if err != nil {
+			return nil, fmt.Errorf("applying middleware: %v", err)
+		}
+	}
+	newBody, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return joinMIME(hdr, newBody), nil
+}
+
+// splitMIME parses the header block at the start of an RFC 5322
+// message and returns it along with the remaining body.
+func splitMIME(data []byte) (textproto.MIMEHeader, []byte, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(data)))
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, nil, fmt.Errorf("parsing message: %v", err)
+	}
+	i := bytes.Index(data, []byte("\n\n"))
+	if i < 0 {
+		return hdr, nil, nil
+	}
+	return hdr, data[i+2:], nil
+}
+
+// joinMIME renders hdr and body back into a single RFC 5322 message.
+func joinMIME(hdr textproto.MIMEHeader, body []byte) []byte {
+	var buf bytes.Buffer
+	var keys []string
+	for k := range hdr {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range hdr[k] {
+			fmt.Fprintf(&buf, "%s: %s\n", k, v)
+		}
+	}
+	buf.WriteString("\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// deliver sends data through activeTransport. If the attempt fails
+// with a RetryableError, it spools the message for later redelivery
+// by Flush instead of dying, so that a transient Mailgun or SMTP
+// outage does not lose mail queued by cron jobs and scripts expecting
+// sendmail semantics.
+func deliver(from *mail.Address, to []*mail.Address, data []byte) {
+	err := activeTransport.Send(from, to, bytes.NewReader(data))
+	if err == nil {
+		return
+	}
+	if IsRetryable(err) {
+		if serr := Spool(from, to, bytes.NewReader(data)); serr == nil {
+			Logf("delivery deferred, spooling: %v", err)
+			return
+		}
+	}
+	Die(err)
 }
 
 func Logf(format string, args ...interface{}) {
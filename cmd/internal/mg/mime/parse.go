@@ -0,0 +1,148 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mime parses RFC 5322 messages built by mg.buildMIME back
+// into their component parts, the reverse of sending: a plain text
+// body, an optional HTML alternative, any inline images, and any
+// attachments. It is used by mailgun-sendmail -t and mailgun-mail
+// --parse to verify that a message round-trips correctly.
+package mime
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// A Message is the result of parsing a MIME message, mirroring the
+// shape of mg.Message but holding decoded content rather than the
+// file names and templates used to build one.
+type Message struct {
+	Header      mail.Header
+	TextBody    string
+	HTMLBody    string
+	Inlines     []Inline
+	Attachments []Attachment
+}
+
+// An Attachment is a decoded non-inline MIME part.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// An Inline is a decoded MIME part referenced from the HTML body by
+// a "cid:" URL, the counterpart of mg.InlineFile.
+type Inline struct {
+	CID         string
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Parse reads a full RFC 5322 message from r, walking its MIME
+// structure (multipart/mixed, multipart/alternative, and
+// multipart/related, in whatever nesting mg.buildMIME produces) and
+// decoding each part's Content-Transfer-Encoding.
+func Parse(r io.Reader) (*Message, error) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("mime: %v", err)
+	}
+	msg := &Message{Header: mail.Header(m.Header)}
+	if err := addPart(msg, textproto.MIMEHeader(m.Header), m.Body); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// addPart decodes the MIME part described by hdr and body into msg,
+// recursing into nested multipart parts as needed.
+func addPart(msg *Message, hdr textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("mime: %v", err)
+			}
+			if err := addPart(msg, textproto.MIMEHeader(part.Header), part); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data, err := decodeBody(hdr, body)
+	if err != nil {
+		return fmt.Errorf("mime: decoding part: %v", err)
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(hdr.Get("Content-Disposition"))
+	filename := decodeWord(dparams["filename"])
+	if filename == "" {
+		filename = decodeWord(params["name"])
+	}
+	cid := strings.Trim(hdr.Get("Content-Id"), "<>")
+
+	switch {
+	case cid != "":
+		msg.Inlines = append(msg.Inlines, Inline{CID: cid, Filename: filename, ContentType: mediaType, Data: data})
+	case disposition == "attachment" || (filename != "" && mediaType != "text/plain" && mediaType != "text/html"):
+		msg.Attachments = append(msg.Attachments, Attachment{Filename: filename, ContentType: mediaType, Data: data})
+	case mediaType == "text/html":
+		if msg.HTMLBody == "" {
+			msg.HTMLBody = string(data)
+		}
+	default:
+		if msg.TextBody == "" {
+			msg.TextBody = string(data)
+		}
+	}
+	return nil
+}
+
+// decodeBody returns the decoded bytes of a leaf MIME part, undoing
+// whatever Content-Transfer-Encoding the part declares.
+func decodeBody(hdr textproto.MIMEHeader, body io.Reader) ([]byte, error) {
+	switch strings.ToLower(hdr.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		return ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, body))
+	case "quoted-printable":
+		return ioutil.ReadAll(quotedprintable.NewReader(body))
+	default:
+		return ioutil.ReadAll(body)
+	}
+}
+
+// decodeWord best-effort decodes an RFC 2047 encoded-word value,
+// such as a filename, returning s unchanged if it is not encoded or
+// fails to decode.
+func decodeWord(s string) string {
+	if s == "" {
+		return s
+	}
+	d := new(mime.WordDecoder)
+	dec, err := d.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return dec
+}
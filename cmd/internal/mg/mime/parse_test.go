@@ -0,0 +1,124 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mime
+
+import (
+	"bytes"
+	"net/mail"
+	"testing"
+)
+
+func baseMessage() *Message {
+	return &Message{
+		Header:   mail.Header{"From": {"from@example.com"}, "Subject": {"hi"}},
+		TextBody: "plain text body",
+	}
+}
+
+// roundTrip renders msg, then parses the result back, so tests can
+// assert on what a consumer of the re-emitted bytes would see.
+func roundTrip(t *testing.T, msg *Message) *Message {
+	t.Helper()
+	data, err := Render(msg)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if !bytes.Contains(data, []byte("MIME-Version: 1.0")) {
+		t.Errorf("rendered message is missing MIME-Version header:\n%s", data)
+	}
+	parsed, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse: %v\n%s", err, data)
+	}
+	return parsed
+}
+
+func TestRoundTripPlainText(t *testing.T) {
+	parsed := roundTrip(t, baseMessage())
+	if parsed.TextBody != "plain text body" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "plain text body")
+	}
+	if parsed.HTMLBody != "" {
+		t.Errorf("HTMLBody = %q, want empty", parsed.HTMLBody)
+	}
+}
+
+func TestRoundTripHTMLAlternative(t *testing.T) {
+	msg := baseMessage()
+	msg.HTMLBody = "<p>plain text body</p>"
+	parsed := roundTrip(t, msg)
+
+	if parsed.TextBody != "plain text body" {
+		t.Errorf("TextBody = %q, want %q", parsed.TextBody, "plain text body")
+	}
+	if parsed.HTMLBody != "<p>plain text body</p>" {
+		t.Errorf("HTMLBody = %q, want %q", parsed.HTMLBody, "<p>plain text body</p>")
+	}
+}
+
+func TestRoundTripInlineImage(t *testing.T) {
+	msg := baseMessage()
+	msg.HTMLBody = `<img src="cid:logo">`
+	msg.Inlines = []Inline{{CID: "logo", Filename: "logo.png", ContentType: "image/png", Data: []byte("fake png bytes")}}
+	parsed := roundTrip(t, msg)
+
+	if len(parsed.Inlines) != 1 {
+		t.Fatalf("Inlines = %v, want 1 entry", parsed.Inlines)
+	}
+	in := parsed.Inlines[0]
+	if in.CID != "logo" || in.Filename != "logo.png" || in.ContentType != "image/png" {
+		t.Errorf("Inline = %+v, want CID=logo Filename=logo.png ContentType=image/png", in)
+	}
+	if string(in.Data) != "fake png bytes" {
+		t.Errorf("Inline Data = %q, want %q", in.Data, "fake png bytes")
+	}
+}
+
+func TestRoundTripAttachmentsBase64(t *testing.T) {
+	msg := baseMessage()
+	msg.Attachments = []Attachment{
+		{Filename: "report.txt", ContentType: "text/plain", Data: []byte("report contents")},
+		{Filename: "logo.png", ContentType: "image/png", Data: []byte("fake png bytes")},
+	}
+	data, err := Render(msg)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if !bytes.Contains(data, []byte("Content-Transfer-Encoding: base64")) {
+		t.Errorf("rendered attachments are not base64-encoded:\n%s", data)
+	}
+
+	parsed, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse: %v\n%s", err, data)
+	}
+	if len(parsed.Attachments) != 2 {
+		t.Fatalf("Attachments = %v, want 2 entries", parsed.Attachments)
+	}
+	if parsed.Attachments[0].Filename != "report.txt" || string(parsed.Attachments[0].Data) != "report contents" {
+		t.Errorf("Attachments[0] = %+v, want report.txt/\"report contents\"", parsed.Attachments[0])
+	}
+	if parsed.Attachments[1].Filename != "logo.png" || string(parsed.Attachments[1].Data) != "fake png bytes" {
+		t.Errorf("Attachments[1] = %+v, want logo.png/\"fake png bytes\"", parsed.Attachments[1])
+	}
+}
+
+func TestParsePreservesHeader(t *testing.T) {
+	msg := baseMessage()
+	data, err := Render(msg)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	parsed, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := parsed.Header.Get("Subject"); got != "hi" {
+		t.Errorf("Subject = %q, want %q", got, "hi")
+	}
+	if got := parsed.Header.Get("From"); got != "from@example.com" {
+		t.Errorf("From = %q, want %q", got, "from@example.com")
+	}
+}
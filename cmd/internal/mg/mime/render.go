@@ -0,0 +1,167 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mime
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+)
+
+// Render serializes msg back into a full RFC 5322 message, rebuilding
+// whatever multipart/alternative, multipart/related, and
+// multipart/mixed structure its HTMLBody, Inlines, and Attachments
+// call for, base64-encoding each inline and attachment part. It is
+// the inverse of Parse, and is used by mailgun-sendmail -t to
+// re-emit a piped-in message in normalized MIME form rather than
+// forwarding its raw bytes unchanged.
+func Render(msg *Message) ([]byte, error) {
+	var hdr bytes.Buffer
+	var keys []string
+	for k := range msg.Header {
+		switch k {
+		case "Mime-Version", "Content-Type", "Content-Transfer-Encoding":
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range msg.Header[k] {
+			fmt.Fprintf(&hdr, "%s: %s\n", k, v)
+		}
+	}
+	fmt.Fprintf(&hdr, "MIME-Version: 1.0\n")
+
+	bodyType, body, err := renderBody(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg.Attachments) == 0 {
+		fmt.Fprintf(&hdr, "Content-Type: %s\n\n", bodyType)
+		return concat(&hdr, body)
+	}
+
+	var mixed bytes.Buffer
+	w := multipart.NewWriter(&mixed)
+	fmt.Fprintf(&hdr, "Content-Type: multipart/mixed; boundary=%s\n\n", w.Boundary())
+
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {bodyType}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(body); err != nil {
+		return nil, err
+	}
+	for _, a := range msg.Attachments {
+		if err := renderPart(w, "attachment", a.ContentType, a.Filename, "", a.Data); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return concat(&hdr, mixed.Bytes())
+}
+
+// renderBody renders msg's TextBody, alternated with its HTMLBody
+// (and any Inlines related to it) if set, mirroring mg.buildBody.
+func renderBody(msg *Message) (contentType string, body []byte, err error) {
+	if msg.HTMLBody == "" {
+		return "text/plain; charset=utf-8", []byte(msg.TextBody), nil
+	}
+
+	htmlType, htmlBody, err := renderHTMLPart(msg)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	text, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return "", nil, err
+	}
+	io.WriteString(text, msg.TextBody)
+
+	html, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {htmlType}})
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := html.Write(htmlBody); err != nil {
+		return "", nil, err
+	}
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("multipart/alternative; boundary=%s", w.Boundary()), buf.Bytes(), nil
+}
+
+// renderHTMLPart renders msg's HTMLBody, wrapping it in
+// multipart/related with its Inlines if there are any.
+func renderHTMLPart(msg *Message) (contentType string, body []byte, err error) {
+	if len(msg.Inlines) == 0 {
+		return "text/html; charset=utf-8", []byte(msg.HTMLBody), nil
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	html, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}})
+	if err != nil {
+		return "", nil, err
+	}
+	io.WriteString(html, msg.HTMLBody)
+
+	for _, in := range msg.Inlines {
+		if err := renderPart(w, "inline", in.ContentType, in.Filename, in.CID, in.Data); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("multipart/related; boundary=%s", w.Boundary()), buf.Bytes(), nil
+}
+
+// renderPart writes data to w as a base64-encoded part with the
+// given Content-Disposition (e.g. "attachment" or "inline") and
+// filename. If cid is non-empty, the part also gets a Content-ID
+// header so an HTML body can reference it as cid:cid.
+func renderPart(w *multipart.Writer, disposition, contentType, filename, cid string, data []byte) error {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {fmt.Sprintf("%s; filename=%q", disposition, filename)},
+	}
+	if cid != "" {
+		header.Set("Content-ID", "<"+cid+">")
+	}
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, part)
+	if _, err := enc.Write(data); err != nil {
+		return fmt.Errorf("rendering part: %v", err)
+	}
+	return enc.Close()
+}
+
+// concat returns the concatenation of hdr and body as a single byte
+// slice.
+func concat(hdr *bytes.Buffer, body []byte) ([]byte, error) {
+	out := make([]byte, 0, hdr.Len()+len(body))
+	out = append(out, hdr.Bytes()...)
+	out = append(out, body...)
+	return out, nil
+}
@@ -0,0 +1,241 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// A PGPKeyring holds the OpenPGP keys used by PGPSign and PGPEncrypt,
+// loaded from a gpg --export(-secret-keys) armored keyring file.
+type PGPKeyring struct {
+	path     string
+	entities openpgp.EntityList
+}
+
+// LoadPGPKeyring reads an ASCII-armored keyring from path. If
+// passphrase is non-empty, it is used to decrypt any encrypted
+// private keys found in the ring.
+func LoadPGPKeyring(path, passphrase string) (*PGPKeyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("pgp: %v", err)
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("pgp: reading keyring %s: %v", path, err)
+	}
+	if passphrase != "" {
+		pass := []byte(passphrase)
+		for _, e := range entities {
+			if e.PrivateKey != nil && e.PrivateKey.Encrypted {
+				if err := e.PrivateKey.Decrypt(pass); err != nil {
+					return nil, fmt.Errorf("pgp: decrypting private key in %s: %v", path, err)
+				}
+			}
+			for _, sk := range e.Subkeys {
+				if sk.PrivateKey != nil && sk.PrivateKey.Encrypted {
+					if err := sk.PrivateKey.Decrypt(pass); err != nil {
+						return nil, fmt.Errorf("pgp: decrypting subkey in %s: %v", path, err)
+					}
+				}
+			}
+		}
+	}
+	return &PGPKeyring{path: path, entities: entities}, nil
+}
+
+// PGPKeyFile returns the location of the PGP keyring used by --sign
+// and --encrypt, following the same kind of search order as the
+// mailgun key itself: $MAILGUNPGPKEY names the file directly, else
+// $HOME/.mailgun.pgp.key if present, else /etc/mailgun.pgp.key.
+func PGPKeyFile() string {
+	if f := os.Getenv("MAILGUNPGPKEY"); f != "" {
+		return f
+	}
+	if f := os.Getenv("HOME") + "/.mailgun.pgp.key"; fileExists(f) {
+		return f
+	}
+	return "/etc/mailgun.pgp.key"
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func entityMatchesAddress(e *openpgp.Entity, addr string) bool {
+	for _, ident := range e.Identities {
+		a, err := mail.ParseAddress(ident.UserId.Email)
+		if err == nil && strings.EqualFold(a.Address, addr) {
+			return true
+		}
+		if strings.EqualFold(ident.UserId.Email, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// PGPSign is a MIMEMiddleware that wraps a message's rendered body in
+// multipart/signed, per RFC 3156, with a detached ASCII-armored
+// OpenPGP signature from the first usable private key in Keyring.
+type PGPSign struct {
+	Keyring *PGPKeyring
+}
+
+func (m *PGPSign) signer() *openpgp.Entity {
+	for _, e := range m.Keyring.entities {
+		if e.PrivateKey != nil && !e.PrivateKey.Encrypted {
+			return e
+		}
+	}
+	return nil
+}
+
+func (m *PGPSign) ApplyMIME(hdr textproto.MIMEHeader, body io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	signer := m.signer()
+	if signer == nil {
+		return nil, fmt.Errorf("pgp: no usable signing key in %s", m.Keyring.path)
+	}
+
+	var sig bytes.Buffer
+	armorW, err := armor.Encode(&sig, "PGP SIGNATURE", nil)
+	if err != nil {
+		return nil, fmt.Errorf("pgp: %v", err)
+	}
+	if err := openpgp.DetachSign(armorW, signer, bytes.NewReader(data), nil); err != nil {
+		return nil, fmt.Errorf("pgp: signing: %v", err)
+	}
+	if err := armorW.Close(); err != nil {
+		return nil, fmt.Errorf("pgp: %v", err)
+	}
+
+	contentType := hdr.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	signed, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := signed.Write(data); err != nil {
+		return nil, err
+	}
+	sigPart, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {`application/pgp-signature; name="signature.asc"`},
+		"Content-Description": {"OpenPGP digital signature"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := sigPart.Write(sig.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	hdr.Set("Content-Type", fmt.Sprintf(
+		`multipart/signed; protocol="application/pgp-signature"; micalg="pgp-sha256"; boundary=%s`, w.Boundary()))
+	return &buf, nil
+}
+
+// PGPEncrypt is a MIMEMiddleware that encrypts a message's rendered
+// body into the RFC 3156 multipart/encrypted form, to whichever keys
+// in Keyring have an identity matching an address in To.
+type PGPEncrypt struct {
+	Keyring *PGPKeyring
+	To      []*mail.Address
+}
+
+func (m *PGPEncrypt) recipients() openpgp.EntityList {
+	var keys openpgp.EntityList
+	for _, e := range m.Keyring.entities {
+		for _, to := range m.To {
+			if entityMatchesAddress(e, to.Address) {
+				keys = append(keys, e)
+				break
+			}
+		}
+	}
+	return keys
+}
+
+func (m *PGPEncrypt) ApplyMIME(hdr textproto.MIMEHeader, body io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	recipients := m.recipients()
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("pgp: no recipient key in %s matches envelope To", m.Keyring.path)
+	}
+
+	var enc bytes.Buffer
+	armorW, err := armor.Encode(&enc, "PGP MESSAGE", nil)
+	if err != nil {
+		return nil, fmt.Errorf("pgp: %v", err)
+	}
+	plainW, err := openpgp.Encrypt(armorW, recipients, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("pgp: encrypting: %v", err)
+	}
+	if _, err := plainW.Write(data); err != nil {
+		return nil, fmt.Errorf("pgp: encrypting: %v", err)
+	}
+	if err := plainW.Close(); err != nil {
+		return nil, fmt.Errorf("pgp: encrypting: %v", err)
+	}
+	if err := armorW.Close(); err != nil {
+		return nil, fmt.Errorf("pgp: %v", err)
+	}
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	ctrl, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/pgp-encrypted"}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(ctrl, "Version: 1\n"); err != nil {
+		return nil, err
+	}
+	encPart, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {`application/octet-stream; name="encrypted.asc"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := encPart.Write(enc.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	hdr.Set("Content-Type", fmt.Sprintf(
+		`multipart/encrypted; protocol="application/pgp-encrypted"; boundary=%s`, w.Boundary()))
+	return &buf, nil
+}
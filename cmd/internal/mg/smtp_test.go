@@ -0,0 +1,274 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPTransaction is what a fakeSMTPServer recorded about the one
+// message it expects to receive.
+type fakeSMTPTransaction struct {
+	authUser string
+	authPass string
+	from     string
+	to       []string
+	data     string
+}
+
+// fakeSMTPServer runs a minimal SMTP server on a loopback listener
+// for exactly one transaction, handling EHLO, AUTH PLAIN/LOGIN,
+// STARTTLS, MAIL/RCPT/DATA, and QUIT. It reports the transaction (or
+// a test failure) on done.
+func fakeSMTPServer(t *testing.T, authMechs string, tlsConfig *tls.Config) (addr string, done <-chan fakeSMTPTransaction) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ch := make(chan fakeSMTPTransaction, 1)
+	go func() {
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("accept: %v", err)
+			return
+		}
+		defer conn.Close()
+		var txn fakeSMTPTransaction
+		if err := serveFakeSMTP(conn, authMechs, tlsConfig, &txn); err != nil {
+			t.Errorf("fake smtp server: %v", err)
+			return
+		}
+		ch <- txn
+	}()
+	return ln.Addr().String(), ch
+}
+
+func serveFakeSMTP(conn net.Conn, authMechs string, tlsConfig *tls.Config, txn *fakeSMTPTransaction) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	w := conn
+
+	write := func(format string, args ...interface{}) error {
+		_, err := fmt.Fprintf(w, format+"\r\n", args...)
+		return err
+	}
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+
+	if err := write("220 localhost ESMTP"); err != nil {
+		return err
+	}
+
+	for {
+		line, err := readLine()
+		if err != nil {
+			return fmt.Errorf("reading command: %v", err)
+		}
+		upper := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(upper, "EHLO"):
+			write("250-localhost")
+			if authMechs != "" {
+				write("250-AUTH %s", authMechs)
+			}
+			if tlsConfig != nil {
+				write("250-STARTTLS")
+			}
+			write("250 HELP")
+
+		case upper == "STARTTLS":
+			if err := write("220 go ahead"); err != nil {
+				return err
+			}
+			tlsConn := tls.Server(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return fmt.Errorf("tls handshake: %v", err)
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			w = conn
+
+		case strings.HasPrefix(upper, "AUTH PLAIN"):
+			b64 := strings.TrimSpace(line[len("AUTH PLAIN"):])
+			dec, err := base64.StdEncoding.DecodeString(b64)
+			if err != nil {
+				return fmt.Errorf("decoding AUTH PLAIN: %v", err)
+			}
+			parts := bytes.Split(dec, []byte{0})
+			if len(parts) == 3 {
+				txn.authUser = string(parts[1])
+				txn.authPass = string(parts[2])
+			}
+			write("235 2.7.0 authenticated")
+
+		case upper == "AUTH LOGIN":
+			write("334 %s", base64.StdEncoding.EncodeToString([]byte("Username:")))
+			userLine, err := readLine()
+			if err != nil {
+				return err
+			}
+			user, err := base64.StdEncoding.DecodeString(userLine)
+			if err != nil {
+				return fmt.Errorf("decoding LOGIN username: %v", err)
+			}
+			txn.authUser = string(user)
+			write("334 %s", base64.StdEncoding.EncodeToString([]byte("Password:")))
+			passLine, err := readLine()
+			if err != nil {
+				return err
+			}
+			pass, err := base64.StdEncoding.DecodeString(passLine)
+			if err != nil {
+				return fmt.Errorf("decoding LOGIN password: %v", err)
+			}
+			txn.authPass = string(pass)
+			write("235 2.7.0 authenticated")
+
+		case strings.HasPrefix(upper, "MAIL FROM:"):
+			txn.from = line[len("MAIL FROM:"):]
+			write("250 OK")
+
+		case strings.HasPrefix(upper, "RCPT TO:"):
+			txn.to = append(txn.to, line[len("RCPT TO:"):])
+			write("250 OK")
+
+		case upper == "DATA":
+			write("354 go ahead")
+			var data bytes.Buffer
+			for {
+				dline, err := readLine()
+				if err != nil {
+					return fmt.Errorf("reading DATA: %v", err)
+				}
+				if dline == "." {
+					break
+				}
+				data.WriteString(dline)
+				data.WriteString("\n")
+			}
+			txn.data = data.String()
+			write("250 OK")
+
+		case upper == "QUIT":
+			write("221 closing")
+			return nil
+
+		default:
+			write("500 unrecognized command")
+		}
+	}
+}
+
+// selfSignedCert generates an ephemeral self-signed certificate for
+// 127.0.0.1, for tests that need a fake TLS SMTP server.
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parsing certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return cert, pool
+}
+
+func TestSMTPTransportPlainAuth(t *testing.T) {
+	addr, done := fakeSMTPServer(t, "PLAIN", nil)
+
+	transport := &smtpTransport{addr: addr, user: "alice", pass: "hunter2"}
+	from, to := mustAddr(t, "from@example.com"), []*mail.Address{mustAddr(t, "to@example.com")}
+	if err := transport.Send(from, to, strings.NewReader("Subject: hi\n\nbody\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	txn := <-done
+	if txn.authUser != "alice" || txn.authPass != "hunter2" {
+		t.Errorf("auth = %q/%q, want alice/hunter2", txn.authUser, txn.authPass)
+	}
+	if !strings.Contains(txn.data, "body") {
+		t.Errorf("data = %q, want it to contain %q", txn.data, "body")
+	}
+}
+
+func TestSMTPTransportLoginAuth(t *testing.T) {
+	addr, done := fakeSMTPServer(t, "LOGIN", nil)
+
+	transport := &smtpTransport{addr: addr, user: "bob", pass: "swordfish"}
+	from, to := mustAddr(t, "from@example.com"), []*mail.Address{mustAddr(t, "to@example.com")}
+	if err := transport.Send(from, to, strings.NewReader("Subject: hi\n\nbody\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	txn := <-done
+	if txn.authUser != "bob" || txn.authPass != "swordfish" {
+		t.Errorf("auth = %q/%q, want bob/swordfish", txn.authUser, txn.authPass)
+	}
+}
+
+func TestSMTPTransportStartTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	addr, done := fakeSMTPServer(t, "PLAIN", tlsConfig)
+
+	old := smtpRootCAs
+	smtpRootCAs = pool
+	defer func() { smtpRootCAs = old }()
+
+	transport := &smtpTransport{addr: addr, security: "starttls", user: "carol", pass: "letmein"}
+	from, to := mustAddr(t, "from@example.com"), []*mail.Address{mustAddr(t, "to@example.com")}
+	if err := transport.Send(from, to, strings.NewReader("Subject: hi\n\nbody\n")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	txn := <-done
+	if txn.authUser != "carol" || txn.authPass != "letmein" {
+		t.Errorf("auth = %q/%q, want carol/letmein", txn.authUser, txn.authPass)
+	}
+	if len(txn.to) != 1 || !strings.Contains(txn.to[0], "to@example.com") {
+		t.Errorf("to = %v, want it to contain to@example.com", txn.to)
+	}
+}
+
+func mustAddr(t *testing.T, addr string) *mail.Address {
+	t.Helper()
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		t.Fatalf("ParseAddress(%q): %v", addr, err)
+	}
+	return a
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SpoolDir is the directory where messages are held after a delivery
+// attempt fails with a RetryableError. It is created with mode 0700 so
+// that queued mail, which may contain sensitive content, is not
+// world-readable.
+var SpoolDir = "/var/spool/mailgun"
+
+// BounceLog is where Flush records the messages it gives up on: those
+// that have sat in the spool for longer than maxSpoolAge, and those
+// whose retry fails with an error that is not a RetryableError.
+var BounceLog = "/var/spool/mailgun/bounces.log"
+
+// backoff gives the delay before each retry attempt; attempts beyond
+// the end of the list reuse the last (capped) entry.
+var backoff = []time.Duration{
+	1 * time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	24 * time.Hour,
+}
+
+// maxSpoolAge is how long a message is retried before Flush gives up
+// on it and writes it to BounceLog.
+var maxSpoolAge = 5 * 24 * time.Hour
+
+// spoolEnvelope is the JSON header written at the start of each
+// spooled file on a single line, followed by a newline and then the
+// raw MIME body.
+type spoolEnvelope struct {
+	From    string
+	To      []string
+	Queued  time.Time
+	Attempt int
+	NextTry time.Time
+}
+
+// Spool writes a pending message to SpoolDir for later delivery by
+// Flush. It is called from deliver when activeTransport.Send fails
+// with a RetryableError, so that a transient outage does not lose
+// mail that a caller expects sendmail semantics to have accepted.
+func Spool(from *mail.Address, to []*mail.Address, mime io.Reader) error {
+	if err := os.MkdirAll(SpoolDir, 0700); err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+	body, err := ioutil.ReadAll(mime)
+	if err != nil {
+		return fmt.Errorf("spool: reading message: %v", err)
+	}
+
+	env := spoolEnvelope{From: from.String(), Queued: time.Now(), NextTry: time.Now()}
+	for _, a := range to {
+		env.To = append(env.To, a.String())
+	}
+
+	path := filepath.Join(SpoolDir, spoolName())
+	if err := writeSpoolFile(path, env, body); err != nil {
+		return err
+	}
+	Logf("spooled message to %s", path)
+	return nil
+}
+
+func spoolName() string {
+	return fmt.Sprintf("%d.%d.msg", time.Now().UnixNano(), os.Getpid())
+}
+
+func writeSpoolFile(path string, env spoolEnvelope, body []byte) error {
+	hdr, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+	_, err = f.Write(hdr)
+	if err == nil {
+		_, err = f.Write([]byte("\n"))
+	}
+	if err == nil {
+		_, err = f.Write(body)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("spool: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("spool: %v", err)
+	}
+	return nil
+}
+
+func readSpoolFile(path string) (spoolEnvelope, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return spoolEnvelope{}, nil, err
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return spoolEnvelope{}, nil, fmt.Errorf("missing envelope header")
+	}
+	var env spoolEnvelope
+	if err := json.Unmarshal(data[:i], &env); err != nil {
+		return spoolEnvelope{}, nil, fmt.Errorf("parsing envelope header: %v", err)
+	}
+	return env, data[i+1:], nil
+}
+
+// Flush walks SpoolDir, retrying delivery of every entry whose
+// NextTry has passed. It takes an exclusive lock on SpoolDir for the
+// duration, so that a second, concurrently invoked flusher (e.g. two
+// overlapping cron runs) returns immediately instead of racing the
+// first.
+func Flush() error {
+	if err := os.MkdirAll(SpoolDir, 0700); err != nil {
+		return fmt.Errorf("spool: %v", err)
+	}
+
+	lock, err := lockSpool()
+	if err != nil {
+		if err == errSpoolLocked {
+			return nil
+		}
+		return err
+	}
+	defer lock.Close()
+
+	entries, err := ioutil.ReadDir(SpoolDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("spool: %v", err)
+	}
+	for _, fi := range entries {
+		if !strings.HasSuffix(fi.Name(), ".msg") {
+			continue
+		}
+		flushOne(filepath.Join(SpoolDir, fi.Name()))
+	}
+	return nil
+}
+
+func flushOne(path string) {
+	env, body, err := readSpoolFile(path)
+	if err != nil {
+		Logf("spool: skipping corrupt entry %s: %v", path, err)
+		return
+	}
+	if time.Now().Before(env.NextTry) {
+		return
+	}
+	if time.Since(env.Queued) > maxSpoolAge {
+		bounce(env, fmt.Errorf("giving up after %s in the spool", maxSpoolAge))
+		os.Remove(path)
+		return
+	}
+
+	from, to, err := spoolAddrs(env)
+	if err != nil {
+		Logf("spool: discarding %s: %v", path, err)
+		os.Remove(path)
+		return
+	}
+
+	err = activeTransport.Send(from, to, bytes.NewReader(body))
+	if err == nil {
+		Logf("spool: delivered %s", path)
+		os.Remove(path)
+		return
+	}
+	if !IsRetryable(err) {
+		bounce(env, err)
+		os.Remove(path)
+		return
+	}
+
+	env.Attempt++
+	env.NextTry = time.Now().Add(jitter(backoffDelay(env.Attempt)))
+	if err := writeSpoolFile(path, env, body); err != nil {
+		Logf("spool: %v", err)
+	}
+}
+
+func spoolAddrs(env spoolEnvelope) (from *mail.Address, to []*mail.Address, err error) {
+	from, err = mail.ParseAddress(env.From)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad From %q: %v", env.From, err)
+	}
+	for _, s := range env.To {
+		a, err := mail.ParseAddress(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad To %q: %v", s, err)
+		}
+		to = append(to, a)
+	}
+	return from, to, nil
+}
+
+func backoffDelay(attempt int) time.Duration {
+	if attempt-1 < len(backoff) {
+		return backoff[attempt-1]
+	}
+	return backoff[len(backoff)-1]
+}
+
+// jitter randomizes d to within the range [d/2, 3d/2), so that many
+// messages queued at the same time do not all retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+func bounce(env spoolEnvelope, cause error) {
+	Logf("spool: bouncing message from %s to %v: %v", env.From, env.To, cause)
+	f, err := os.OpenFile(BounceLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		Logf("spool: cannot write bounce log %s: %v", BounceLog, err)
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s from=%s to=%v queued=%s attempts=%d: %v\n",
+		time.Now().Format(time.RFC3339), env.From, env.To, env.Queued.Format(time.RFC3339), env.Attempt, cause)
+}
+
+var errSpoolLocked = fmt.Errorf("spool: already locked")
+
+// lockSpool takes an exclusive, non-blocking lock on a file in
+// SpoolDir, returning errSpoolLocked if another flusher already holds
+// it.
+func lockSpool() (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(SpoolDir, "lock"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("spool: %v", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errSpoolLocked
+		}
+		return nil, fmt.Errorf("spool: locking: %v", err)
+	}
+	return f, nil
+}
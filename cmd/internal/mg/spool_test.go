@@ -0,0 +1,186 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withFakeMailgunAPI points the Mailgun API transport at a fake HTTP
+// server for the duration of a test and restores the previous
+// settings afterwards.
+func withFakeMailgunAPI(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	oldBase, oldDomain, oldKey, oldTransport := mailgunAPIBase, Domain, APIKey, activeTransport
+	mailgunAPIBase = srv.URL + "/v3/"
+	Domain = "example.com"
+	APIKey = "key-test"
+	activeTransport = mailgunAPI{}
+	t.Cleanup(func() {
+		mailgunAPIBase, Domain, APIKey, activeTransport = oldBase, oldDomain, oldKey, oldTransport
+	})
+	return srv
+}
+
+// withSpoolDir points SpoolDir and BounceLog at fresh files under a
+// temporary directory for the duration of a test.
+func withSpoolDir(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	oldSpool, oldBounce := SpoolDir, BounceLog
+	SpoolDir = dir
+	BounceLog = filepath.Join(dir, "bounces.log")
+	t.Cleanup(func() { SpoolDir, BounceLog = oldSpool, oldBounce })
+}
+
+func TestSpoolFlushRetriesAfterTransientFailure(t *testing.T) {
+	withSpoolDir(t)
+
+	var requests int
+	srv := withFakeMailgunAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("server busy"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"message":"Queued. Thank you.","id":"<20170101.1@example.com>"}`))
+	})
+	defer srv.Close()
+
+	from := mustAddr(t, "from@example.com")
+	to := []*mail.Address{mustAddr(t, "to@example.com")}
+	data := []byte("From: from@example.com\nTo: to@example.com\nSubject: hi\n\nbody\n")
+
+	// First attempt hits the 503 and should spool instead of dying.
+	deliver(from, to, data)
+	if requests != 1 {
+		t.Fatalf("requests after deliver = %d, want 1", requests)
+	}
+
+	entries, err := ioutil.ReadDir(SpoolDir)
+	if err != nil {
+		t.Fatalf("ReadDir(SpoolDir): %v", err)
+	}
+	var spooled []string
+	for _, fi := range entries {
+		if strings.HasSuffix(fi.Name(), ".msg") {
+			spooled = append(spooled, fi.Name())
+		}
+	}
+	if len(spooled) != 1 {
+		t.Fatalf("spool files = %v, want exactly one .msg file", spooled)
+	}
+
+	// Flush should retry immediately (NextTry was set to now by Spool)
+	// and this time succeed, removing the spooled file.
+	if err := Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if requests != 2 {
+		t.Fatalf("requests after Flush = %d, want 2", requests)
+	}
+
+	entries, err = ioutil.ReadDir(SpoolDir)
+	if err != nil {
+		t.Fatalf("ReadDir(SpoolDir): %v", err)
+	}
+	for _, fi := range entries {
+		if strings.HasSuffix(fi.Name(), ".msg") {
+			t.Errorf("spool file %s still present after successful Flush", fi.Name())
+		}
+	}
+}
+
+func TestFlushCreatesSpoolDir(t *testing.T) {
+	oldSpool := SpoolDir
+	SpoolDir = filepath.Join(t.TempDir(), "never-created")
+	t.Cleanup(func() { SpoolDir = oldSpool })
+
+	if err := Flush(); err != nil {
+		t.Fatalf("Flush() on a never-created SpoolDir: %v", err)
+	}
+	if fi, err := os.Stat(SpoolDir); err != nil || !fi.IsDir() {
+		t.Fatalf("SpoolDir %s was not created: %v", SpoolDir, err)
+	}
+}
+
+func TestFlushBouncesAfterMaxSpoolAge(t *testing.T) {
+	withSpoolDir(t)
+	withFakeMailgunAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	oldMaxAge := maxSpoolAge
+	maxSpoolAge = 0
+	defer func() { maxSpoolAge = oldMaxAge }()
+
+	from := mustAddr(t, "from@example.com")
+	to := []*mail.Address{mustAddr(t, "to@example.com")}
+	if err := Spool(from, to, strings.NewReader("Subject: hi\n\nbody\n")); err != nil {
+		t.Fatalf("Spool: %v", err)
+	}
+
+	if err := Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(SpoolDir)
+	if err != nil {
+		t.Fatalf("ReadDir(SpoolDir): %v", err)
+	}
+	for _, fi := range entries {
+		if strings.HasSuffix(fi.Name(), ".msg") {
+			t.Errorf("spool file %s still present after giving up", fi.Name())
+		}
+	}
+
+	log, err := ioutil.ReadFile(BounceLog)
+	if err != nil {
+		t.Fatalf("reading BounceLog: %v", err)
+	}
+	if !strings.Contains(string(log), "giving up") {
+		t.Errorf("BounceLog = %q, want it to mention giving up", log)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 1 * time.Minute},
+		{2, 5 * time.Minute},
+		{5, 24 * time.Hour},
+		{50, 24 * time.Hour}, // beyond the table, caps at the last entry
+	}
+	for _, c := range cases {
+		if got := backoffDelay(c.attempt); got != c.want {
+			t.Errorf("backoffDelay(%d) = %v, want %v", c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	d := 10 * time.Minute
+	for i := 0; i < 100; i++ {
+		got := jitter(d)
+		if got < d/2 || got >= 3*d/2 {
+			t.Fatalf("jitter(%v) = %v, want in [%v, %v)", d, got, d/2, 3*d/2)
+		}
+	}
+}
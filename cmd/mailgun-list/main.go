@@ -0,0 +1,308 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Mailgun-list is a minimal mailing-list exploder: invoked from a
+// .forward file or mail alias for a list address, it reads a message
+// from standard input and fans it out to the list's members using
+// Mailgun.
+//
+// Usage:
+//
+//	mailgun-list --list name@domain --members file [options]
+//
+// The options are:
+//
+//	--list address
+//	    the list's own address, name@domain
+//	--members file
+//	    file of member addresses, one per line, to receive the post
+//	    and (unless --open or --newsletter) to post to the list
+//	--open
+//	    allow a post from any sender, not just --members
+//	--newsletter
+//	    newsletter mode: only senders listed in .owners, a file in
+//	    the current directory, may post
+//	--maxsize bytes
+//	    reject messages larger than bytes (default 10MB)
+//	--bounce-mbox file
+//	    local mbox file that rejected posts are appended to, instead
+//	    of being delivered or bounced back through the MTA
+//
+// In the default discussion mode, mailgun-list rewrites the message's
+// From line to "Name via list <list@domain>", sets Reply-To to the
+// list address, adds List-Id, List-Post, and List-Unsubscribe
+// headers, strips any DKIM-Signature and Authentication-Results left
+// over from the original transit, and sets Return-Path to
+// list-bounces@domain. In --newsletter mode the same rewriting
+// applies, but only .owners may post, regardless of --members or
+// --open.
+//
+// Every post is delivered in batches of at most 50 recipients per
+// Mailgun submission, to stay within Mailgun's per-message recipient
+// limit.
+//
+// Configuration
+//
+// Mailgun-list expects to find an mailgun API domain and authorization key
+// of the form "<domain> api:key-<hexstring>" in the environment variable
+// $MAILGUNKEY, or else in the file $HOME/.mailgun.key,
+// or else in the file /etc/mailgun.key.
+//
+// Diagnostics
+//
+// If the file /var/log/mailgun.log can be opened for writing, mailgun
+// logs its actions, successes, and failures there.
+//
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"rsc.io/getopt"
+	"rsc.io/mailgun/cmd/internal/mg"
+)
+
+func usage() {
+	mg.Logf("invalid command line")
+	fmt.Fprintf(os.Stderr, "usage: mailgun-list --list name@domain --members file [options]\n")
+	getopt.PrintDefaults()
+	os.Exit(2)
+}
+
+const maxBatch = 50 // Mailgun's per-submission recipient limit we stay under
+
+func main() {
+	mg.Init()
+
+	var listFlag, membersFlag, bounceFlag string
+	var openFlag, newsletterFlag bool
+	var maxsizeFlag int64
+
+	flag.StringVar(&listFlag, "list", "", "the list's own `address`, name@domain")
+	flag.StringVar(&membersFlag, "members", "", "`file` of member addresses, one per line")
+	flag.BoolVar(&openFlag, "open", false, "allow a post from any sender, not just --members")
+	flag.BoolVar(&newsletterFlag, "newsletter", false, "newsletter mode: only .owners may post")
+	flag.Int64Var(&maxsizeFlag, "maxsize", 10<<20, "reject messages larger than `bytes`")
+	flag.StringVar(&bounceFlag, "bounce-mbox", "/var/spool/mailgun/list-bounces.mbox", "local mbox `file` for rejected posts")
+
+	flag.Usage = usage
+	getopt.Parse()
+	if flag.NArg() != 0 {
+		usage()
+	}
+	if listFlag == "" || membersFlag == "" {
+		mg.Die(fmt.Errorf("--list and --members are required"))
+	}
+
+	list, err := mg.ParseAddress(listFlag)
+	if err != nil {
+		mg.Die(fmt.Errorf("malformed --list address: %v", err))
+	}
+	mg.FixLocalAddr(list)
+
+	members, err := readAddrList(membersFlag)
+	if err != nil {
+		mg.Die(err)
+	}
+
+	var owners []*mail.Address
+	if newsletterFlag {
+		owners, err = readAddrList(".owners")
+		if err != nil {
+			mg.Die(err)
+		}
+	}
+
+	raw, err := ioutil.ReadAll(io.LimitReader(os.Stdin, maxsizeFlag+1))
+	if err != nil {
+		mg.Die(fmt.Errorf("reading message: %v", err))
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		mg.Die(fmt.Errorf("parsing message: %v", err))
+	}
+
+	fromList, err := msg.Header.AddressList("From")
+	if err != nil || len(fromList) == 0 {
+		mg.Die(fmt.Errorf("message has no valid From address"))
+	}
+	sender := fromList[0]
+
+	if int64(len(raw)) > maxsizeFlag {
+		reject(bounceFlag, sender, list, raw, fmt.Errorf("message is larger than --maxsize (%d bytes)", maxsizeFlag))
+		return
+	}
+
+	if !permittedToPost(sender.Address, members, owners, newsletterFlag, openFlag) {
+		reject(bounceFlag, sender, list, raw, fmt.Errorf("sender %s is not permitted to post to %s", sender.Address, list.Address))
+		return
+	}
+
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		mg.Die(fmt.Errorf("reading message body: %v", err))
+	}
+
+	hdr := rewriteHeaders(msg.Header, sender, list)
+	var out bytes.Buffer
+	writeHeaders(&out, hdr)
+	out.Write(body)
+
+	for i := 0; i < len(members); i += maxBatch {
+		end := i + maxBatch
+		if end > len(members) {
+			end = len(members)
+		}
+		mg.MailMIME(list, members[i:end], bytes.NewReader(out.Bytes()))
+	}
+}
+
+// rewriteHeaders copies h, rewriting it the way a discussion or
+// newsletter list traditionally does: the visible From becomes the
+// list's own address (with the original sender named in display
+// form), replies go back to the list, list-management headers are
+// added, and DKIM headers that no longer apply once the message is
+// re-sent from the list are stripped.
+func rewriteHeaders(h mail.Header, sender, list *mail.Address) mail.Header {
+	out := mail.Header{}
+	for k, v := range h {
+		out[k] = v
+	}
+	delete(out, "Dkim-Signature")
+	delete(out, "Authentication-Results")
+	delete(out, "Bcc")
+
+	name := sender.Name
+	if name == "" {
+		name = sender.Address
+	}
+	local, domain := splitAddr(list.Address)
+	listName := list.Name
+	if listName == "" {
+		listName = local
+	}
+
+	from := &mail.Address{Name: fmt.Sprintf("%s via %s", name, listName), Address: list.Address}
+	out["From"] = []string{from.String()}
+	out["Reply-To"] = []string{list.Address}
+	out["List-Id"] = []string{fmt.Sprintf("<%s.%s>", local, domain)}
+	out["List-Post"] = []string{fmt.Sprintf("<mailto:%s>", list.Address)}
+	out["List-Unsubscribe"] = []string{fmt.Sprintf(
+		"<mailto:list-unsubscribe@%s>, <https://%s/lists/%s/unsubscribe>", domain, domain, local)}
+	out["Return-Path"] = []string{fmt.Sprintf("<%s-bounces@%s>", local, domain)}
+	return out
+}
+
+func splitAddr(addr string) (local, domain string) {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return addr, ""
+	}
+	return addr[:i], addr[i+1:]
+}
+
+func writeHeaders(w io.Writer, h mail.Header) {
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s: %s\n", k, v)
+		}
+	}
+	fmt.Fprintf(w, "\n")
+}
+
+func readAddrList(path string) ([]*mail.Address, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	var list []*mail.Address
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		a, err := mg.ParseAddress(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad address %q: %v", path, line, err)
+		}
+		list = append(list, a)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return list, nil
+}
+
+// permittedToPost reports whether addr may post to the list. In
+// --newsletter mode, only owners may post, regardless of open;
+// otherwise members may always post, and open additionally admits
+// any sender.
+func permittedToPost(addr string, members, owners []*mail.Address, newsletter, open bool) bool {
+	if newsletter {
+		return isMember(owners, addr)
+	}
+	return open || isMember(members, addr)
+}
+
+func isMember(list []*mail.Address, addr string) bool {
+	for _, a := range list {
+		if strings.EqualFold(a.Address, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reject appends the rejected message raw to the configured bounce
+// mbox in standard mbox format and returns. Once the mbox is open it
+// does not call mg.Die, so that an MTA invoking mailgun-list as a
+// final delivery agent sees a clean exit and does not also generate
+// its own bounce; if the mbox cannot be opened, it calls mg.Die.
+func reject(mboxPath string, sender, list *mail.Address, raw []byte, cause error) {
+	mg.Logf("mailgun-list: rejecting post from %s to %s: %v", sender.Address, list.Address, cause)
+	f, err := os.OpenFile(mboxPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		mg.Die(fmt.Errorf("cannot write bounce mbox %s: %v", mboxPath, err))
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "From %s %s\n", sender.Address, time.Now().Format(time.ANSIC))
+	fmt.Fprintf(f, "X-Mailgun-List-Reject-Reason: %s\n", cause)
+	f.Write(escapeMboxFrom(raw))
+	if len(raw) == 0 || raw[len(raw)-1] != '\n' {
+		f.Write([]byte("\n"))
+	}
+	f.Write([]byte("\n"))
+}
+
+// mboxFromLine matches a message body line that a naive mbox reader
+// would mistake for the start of the next message, including one
+// already quoted by a previous call to escapeMboxFrom.
+var mboxFromLine = regexp.MustCompile(`(?m)^>*From `)
+
+// escapeMboxFrom quotes any line in body that begins with "From " (or
+// ">From ", ">>From ", and so on) by prefixing it with another ">",
+// the same reversible quoting real mbox writers use, so that a body
+// containing such a line does not split into two messages when the
+// mbox is read back.
+func escapeMboxFrom(body []byte) []byte {
+	return mboxFromLine.ReplaceAll(body, []byte(">$0"))
+}
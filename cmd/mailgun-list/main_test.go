@@ -0,0 +1,161 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func mustAddr(t *testing.T, addr string) *mail.Address {
+	t.Helper()
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		t.Fatalf("ParseAddress(%q): %v", addr, err)
+	}
+	return a
+}
+
+func TestRewriteHeaders(t *testing.T) {
+	h := mail.Header{
+		"From":                   {"Alice <alice@example.com>"},
+		"Subject":                {"hi"},
+		"Dkim-Signature":         {"v=1; ..."},
+		"Authentication-Results": {"mx.example.com; dkim=pass"},
+		"Bcc":                    {"secret@example.com"},
+	}
+	sender := mustAddr(t, "Alice <alice@example.com>")
+	list := mustAddr(t, "Friends <friends@example.com>")
+
+	out := rewriteHeaders(h, sender, list)
+
+	if _, ok := out["Dkim-Signature"]; ok {
+		t.Errorf("Dkim-Signature not stripped")
+	}
+	if _, ok := out["Authentication-Results"]; ok {
+		t.Errorf("Authentication-Results not stripped")
+	}
+	if _, ok := out["Bcc"]; ok {
+		t.Errorf("Bcc not stripped")
+	}
+	if got, want := out["From"], []string{"\"Alice via Friends\" <friends@example.com>"}; !equalStrings(got, want) {
+		t.Errorf("From = %v, want %v", got, want)
+	}
+	if got, want := out["Reply-To"], []string{"friends@example.com"}; !equalStrings(got, want) {
+		t.Errorf("Reply-To = %v, want %v", got, want)
+	}
+	if got, want := out["List-Id"], []string{"<friends.example.com>"}; !equalStrings(got, want) {
+		t.Errorf("List-Id = %v, want %v", got, want)
+	}
+	if got, want := out["List-Post"], []string{"<mailto:friends@example.com>"}; !equalStrings(got, want) {
+		t.Errorf("List-Post = %v, want %v", got, want)
+	}
+	if got, want := out["Return-Path"], []string{"<friends-bounces@example.com>"}; !equalStrings(got, want) {
+		t.Errorf("Return-Path = %v, want %v", got, want)
+	}
+	if got, want := out["Subject"], []string{"hi"}; !equalStrings(got, want) {
+		t.Errorf("Subject = %v, want %v (unrelated headers should be untouched)", got, want)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPermittedToPost(t *testing.T) {
+	members := []*mail.Address{mustAddr(t, "member@example.com")}
+	owners := []*mail.Address{mustAddr(t, "owner@example.com")}
+
+	cases := []struct {
+		name             string
+		addr             string
+		newsletter, open bool
+		want             bool
+	}{
+		{"member may post in discussion mode", "member@example.com", false, false, true},
+		{"stranger refused in discussion mode", "stranger@example.com", false, false, false},
+		{"open admits any sender in discussion mode", "stranger@example.com", false, true, true},
+		{"owner may post in newsletter mode", "owner@example.com", true, false, true},
+		{"member refused in newsletter mode", "member@example.com", true, false, false},
+		{"open does not override newsletter mode's .owners check", "stranger@example.com", true, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := permittedToPost(c.addr, members, owners, c.newsletter, c.open)
+			if got != c.want {
+				t.Errorf("permittedToPost(%q, newsletter=%v, open=%v) = %v, want %v", c.addr, c.newsletter, c.open, got, c.want)
+			}
+		})
+	}
+}
+
+func TestRejectAppendsToMbox(t *testing.T) {
+	mbox := filepath.Join(t.TempDir(), "rejects.mbox")
+	sender := mustAddr(t, "stranger@example.com")
+	list := mustAddr(t, "friends@example.com")
+
+	reject(mbox, sender, list, []byte("Subject: hi\n\nbody\n"), errTestCause)
+	reject(mbox, sender, list, []byte("Subject: again\n\nmore\n"), errTestCause)
+
+	data, err := ioutil.ReadFile(mbox)
+	if err != nil {
+		t.Fatalf("reading mbox: %v", err)
+	}
+	content := string(data)
+	if n := strings.Count(content, "From stranger@example.com "); n != 2 {
+		t.Errorf("mbox has %d \"From \" lines, want 2:\n%s", n, content)
+	}
+	if !strings.Contains(content, "X-Mailgun-List-Reject-Reason: not permitted") {
+		t.Errorf("mbox missing reject reason:\n%s", content)
+	}
+	if !strings.Contains(content, "Subject: hi") || !strings.Contains(content, "Subject: again") {
+		t.Errorf("mbox missing one of the rejected messages:\n%s", content)
+	}
+}
+
+func TestRejectEscapesFromLinesInBody(t *testing.T) {
+	mbox := filepath.Join(t.TempDir(), "rejects.mbox")
+	sender := mustAddr(t, "stranger@example.com")
+	list := mustAddr(t, "friends@example.com")
+
+	reject(mbox, sender, list, []byte("Subject: fwd\n\nFrom bob@example.com, hi there\n"), errTestCause)
+
+	data, err := ioutil.ReadFile(mbox)
+	if err != nil {
+		t.Fatalf("reading mbox: %v", err)
+	}
+	content := string(data)
+	if n := len(mboxMessageStartRE.FindAllString(content, -1)); n != 1 {
+		t.Errorf("mbox has %d unescaped \"From \" line starts, want 1 (the real message boundary):\n%s", n, content)
+	}
+	if !strings.Contains(content, "\n>From bob@example.com, hi there\n") {
+		t.Errorf("mbox body's From line was not quoted with '>':\n%s", content)
+	}
+}
+
+var mboxMessageStartRE = regexp.MustCompile(`(?m)^From `)
+
+func TestEscapeMboxFrom(t *testing.T) {
+	in := "From the start\nsafe line\nFrom also here\n>From already quoted\n"
+	want := ">From the start\nsafe line\n>From also here\n>>From already quoted\n"
+	if got := string(escapeMboxFrom([]byte(in))); got != want {
+		t.Errorf("escapeMboxFrom(%q) = %q, want %q", in, got, want)
+	}
+}
+
+var errTestCause = fmt.Errorf("not permitted")
@@ -7,7 +7,8 @@
 //
 // Usage:
 //
-//	mailgun-mail [-Edntv] [-a file] [-b bcc] [-c cc] [-r from] [-s subject] to...
+//	mailgun-mail [-Edntv] [-a file] [-b bcc] [-c cc] [-r from] [-s subject] [--html file] [--inline cid=file] [--template file] to...
+//	mailgun-mail --parse file
 //
 // Mailgun-mail sends mail to the given "to" addresses.
 //
@@ -30,6 +31,24 @@
 //	-s subject
 //	    set mail subject
 //
+//	--html file
+//	    send file as an HTML alternative to the text body
+//	--inline cid=file
+//	    attach file as an inline image, referenced from the HTML body
+//	    as <img src="cid:cid">; can repeat
+//	--template file
+//	    parse file as a text/template and use its output as the
+//	    text body
+//	--sign
+//	    PGP/MIME-sign the outgoing message
+//	--encrypt
+//	    PGP/MIME-encrypt the outgoing message to its recipients
+//	--parse file
+//	    instead of sending mail, parse file as a MIME message, print a
+//	    summary of its text body, HTML body, inlines, and attachments,
+//	    and exit; useful for debugging what a message built by
+//	    mailgun-mail or another MUA actually contains
+//
 // Configuration
 //
 // Mailgun-mail expects to find an mailgun API domain and authorization key
@@ -37,6 +56,10 @@
 // $MAILGUNKEY, or else in the file $HOME/.mailgun.key,
 // or else in the file /etc/mailgun.key.
 //
+// --sign and --encrypt load an armored PGP keyring from $MAILGUNPGPKEY,
+// or else $HOME/.mailgun.pgp.key, or else /etc/mailgun.pgp.key, decrypting
+// any encrypted private key with the passphrase in $MAILGUNPGPPASS.
+//
 // Diagnostics
 //
 // If the file /var/log/mailgun.log can be opened for writing, mailgun
@@ -50,12 +73,15 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/mail"
 	"os"
 	"strings"
+	"text/template"
 
 	"rsc.io/getopt"
 	"rsc.io/mailgun/cmd/internal/mg"
+	mgmime "rsc.io/mailgun/cmd/internal/mg/mime"
 )
 
 func usage() {
@@ -66,11 +92,13 @@ func usage() {
 }
 
 var (
-	Eflag bool
-	dflag bool
-	nflag bool
-	tflag bool
-	vflag bool
+	Eflag       bool
+	dflag       bool
+	nflag       bool
+	tflag       bool
+	vflag       bool
+	signFlag    bool
+	encryptFlag bool
 )
 
 func main() {
@@ -78,6 +106,8 @@ func main() {
 
 	var to, cc, bcc mg.AddrListFlag
 	var aflag, rflag, sflag mg.StringListFlag
+	var htmlFlag, templateFlag, parseFlag string
+	var inlineFlag mg.StringListFlag
 	var body bytes.Buffer
 
 	flag.BoolVar(&Eflag, "E", false, "discard (do not send) empty messages")
@@ -92,12 +122,24 @@ func main() {
 	flag.Var(&rflag, "r", "send mail from `address`") // list so we can tell empty from missing
 	flag.Var(&sflag, "s", "set message `subject`")    // list so we can tell empty from missing
 
+	flag.StringVar(&htmlFlag, "html", "", "send `file` as an HTML alternative to the text body")
+	flag.Var(&inlineFlag, "inline", "attach `cid=file` as an inline image referenced by the HTML body")
+	flag.StringVar(&templateFlag, "template", "", "parse `file` as a text/template for the message body")
+	flag.BoolVar(&signFlag, "sign", false, "PGP/MIME-sign the outgoing message")
+	flag.BoolVar(&encryptFlag, "encrypt", false, "PGP/MIME-encrypt the outgoing message to its recipients")
+	flag.StringVar(&parseFlag, "parse", "", "parse `file` as a MIME message and print a summary, instead of sending mail")
+
 	flag.Usage = usage
 	getopt.Parse()
 	mg.DisableMail = nflag
 	mg.DebugHTTP = dflag
 	mg.Verbose = vflag
 
+	if parseFlag != "" {
+		parseAndPrint(parseFlag)
+		return
+	}
+
 	// To addresses from command line.
 	if flag.NArg() == 0 && !tflag {
 		mg.Die(fmt.Errorf("mail reading is not supported"))
@@ -223,6 +265,45 @@ Send:
 		Body:        body.String(),
 		Attachments: aflag,
 	}
+
+	if htmlFlag != "" {
+		data, err := ioutil.ReadFile(htmlFlag)
+		if err != nil {
+			mg.Die(fmt.Errorf("reading --html file: %v", err))
+		}
+		msg.HTMLBody = string(data)
+	}
+	for _, kv := range inlineFlag {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			mg.Die(fmt.Errorf("malformed --inline %q, want cid=file", kv))
+		}
+		msg.Inlines = append(msg.Inlines, mg.InlineFile{CID: kv[:i], File: kv[i+1:]})
+	}
+	if templateFlag != "" {
+		tmpl, err := template.ParseFiles(templateFlag)
+		if err != nil {
+			mg.Die(fmt.Errorf("parsing --template file: %v", err))
+		}
+		msg.TextTemplate = tmpl
+	}
+	if signFlag || encryptFlag {
+		kr, err := mg.LoadPGPKeyring(mg.PGPKeyFile(), os.Getenv("MAILGUNPGPPASS"))
+		if err != nil {
+			mg.Die(err)
+		}
+		if signFlag {
+			msg.MIMEMiddlewares = append(msg.MIMEMiddlewares, &mg.PGPSign{Keyring: kr})
+		}
+		if encryptFlag {
+			var allTo []*mail.Address
+			allTo = append(allTo, to...)
+			allTo = append(allTo, cc...)
+			allTo = append(allTo, bcc...)
+			msg.MIMEMiddlewares = append(msg.MIMEMiddlewares, &mg.PGPEncrypt{Keyring: kr, To: allTo})
+		}
+	}
+
 	if vflag {
 		printList := func(x []*mail.Address) string {
 			var s []string
@@ -246,3 +327,34 @@ Send:
 	}
 	mg.Mail(msg)
 }
+
+// parseAndPrint parses file as a MIME message and prints a summary
+// of what --parse found, for debugging what a message actually
+// contains.
+func parseAndPrint(file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		mg.Die(fmt.Errorf("--parse: %v", err))
+	}
+	defer f.Close()
+
+	msg, err := mgmime.Parse(f)
+	if err != nil {
+		mg.Die(fmt.Errorf("--parse: %v", err))
+	}
+
+	fmt.Printf("from: %s\n", strings.Join(msg.Header["From"], ", "))
+	fmt.Printf("to: %s\n", strings.Join(msg.Header["To"], ", "))
+	fmt.Printf("cc: %s\n", strings.Join(msg.Header["Cc"], ", "))
+	fmt.Printf("subject: %s\n", strings.Join(msg.Header["Subject"], ", "))
+	fmt.Printf("text body: %d bytes\n", len(msg.TextBody))
+	if msg.HTMLBody != "" {
+		fmt.Printf("html body: %d bytes\n", len(msg.HTMLBody))
+	}
+	for _, in := range msg.Inlines {
+		fmt.Printf("inline: cid=%s %s %s (%d bytes)\n", in.CID, in.Filename, in.ContentType, len(in.Data))
+	}
+	for _, a := range msg.Attachments {
+		fmt.Printf("attachment: %s %s (%d bytes)\n", a.Filename, a.ContentType, len(a.Data))
+	}
+}
@@ -7,14 +7,17 @@
 //
 // Usage:
 //
-//	mailgun-sendmail [-itv] [-B type] [-b m] [-d val] [-F name] [-f addr] [-r addr] [addr ...]
+//	mailgun-sendmail [-itv] [-B type] [-b m] [-d val] [-F name] [-f addr] [-q] [-r addr] [addr ...]
 //
 // Mailgun-sendmail sends mail to the given addresses.
 //
 // The options are a subset of the standard sendmail options:
 //
 //	-i  ignore single dot lines on incoming message (default unless stdin is TTY)
-//	-t  use To:, Cc:, Bcc: lines from input
+//	-t  use To:, Cc:, Bcc: lines from input; the message is parsed and
+//	    re-emitted with the mg/mime package, so its MIME structure
+//	    (HTML alternative, inlines, base64-encoded attachments) is
+//	    honored rather than forwarded byte-for-byte
 //	-v  verbose mode
 //
 //	-B type
@@ -27,8 +30,27 @@
 //	    set full name of sender
 //	-f addr
 //	    set address of sender
+//	-q
+//	    flush the outbound spool, retrying any previously deferred
+//	    messages, instead of sending a new one; meant to be run from cron
 //	-r addr
 //	    archaic equivalent of -f
+//	--sign
+//	    PGP/MIME-sign the outgoing message
+//	--encrypt
+//	    PGP/MIME-encrypt the outgoing message to its recipients
+//
+// In -v mode, mailgun-sendmail parses the outgoing message with the
+// mg/mime package before sending it, to confirm that its MIME
+// structure (text body, HTML alternative, inlines, attachments) is
+// what the caller intended, and prints a summary of what it found.
+//
+// Delivery and the spool
+//
+// If a delivery attempt fails in a way that looks transient (a network
+// error, or a 5xx/429 response from Mailgun), the message is written to
+// /var/spool/mailgun instead of being lost, for mailgun-sendmail -q or
+// mailgun-spool to retry later with exponential backoff.
 //
 // Configuration
 //
@@ -37,6 +59,10 @@
 // $MAILGUNKEY, or else in the file $HOME/.mailgun.key,
 // or else in the file /etc/mailgun.key.
 //
+// --sign and --encrypt load an armored PGP keyring from $MAILGUNPGPKEY,
+// or else $HOME/.mailgun.pgp.key, or else /etc/mailgun.pgp.key, decrypting
+// any encrypted private key with the passphrase in $MAILGUNPGPPASS.
+//
 // Diagnostics
 //
 // If the file /var/log/mailgun.log can be opened for writing, mailgun
@@ -50,12 +76,14 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/mail"
 	"os"
 	"sort"
 
 	"rsc.io/getopt"
 	"rsc.io/mailgun/cmd/internal/mg"
+	mgmime "rsc.io/mailgun/cmd/internal/mg/mime"
 )
 
 func usage() {
@@ -71,9 +99,12 @@ var (
 	dflag mg.StringListFlag
 	Fflag string
 	fflag string
-	iflag bool
-	tflag bool
-	vflag bool
+	iflag       bool
+	qflag       bool
+	tflag       bool
+	vflag       bool
+	signFlag    bool
+	encryptFlag bool
 
 	to mg.AddrListFlag
 )
@@ -102,11 +133,14 @@ func main() {
 	flag.StringVar(&Fflag, "F", "", "set the full `name` of the sender")
 	flag.StringVar(&fflag, "f", "", "set the `from` address of the mail")
 	flag.BoolVar(&iflag, "i", false, "ignore single dot lines on incoming message")
+	flag.BoolVar(&qflag, "q", false, "flush the outbound spool instead of sending a message")
 	flag.StringVar(&fflag, "r", "", "archaic alias for -f")
 	flag.BoolVar(&tflag, "t", false, "read To:, Cc:, Bcc: lines from message")
 	// flag.Bool("U", false, "ignored (initial user submission)")
 	// flag.String("V", "", "set the envelope `id`")
 	flag.BoolVar(&vflag, "v", false, "verbose mode")
+	flag.BoolVar(&signFlag, "sign", false, "PGP/MIME-sign the outgoing message")
+	flag.BoolVar(&encryptFlag, "encrypt", false, "PGP/MIME-encrypt the outgoing message to its recipients")
 	// flag.Var(&Oflag, "O", "", "set `option=value`")
 
 	flag.Usage = usage
@@ -123,6 +157,13 @@ func main() {
 	}
 	mg.Verbose = vflag
 
+	if qflag {
+		if err := mg.Flush(); err != nil {
+			mg.Die(err)
+		}
+		return
+	}
+
 	if bflag != "m" {
 		mg.Die(fmt.Errorf("only sendmail -bm is supported"))
 	}
@@ -190,7 +231,68 @@ func main() {
 	}
 	fmt.Fprintf(&hdr, "\n")
 
-	mg.MailMIME(from, to, io.MultiReader(&hdr, msg.Body))
+	data, err := ioutil.ReadAll(io.MultiReader(&hdr, msg.Body))
+	if err != nil {
+		mg.Die(fmt.Errorf("reading message: %v", err))
+	}
+	if tflag {
+		// Route the message through the mg/mime parser and back out
+		// so that its MIME structure (text/HTML alternative, inline
+		// images, base64-encoded attachments) is honored rather than
+		// forwarded as whatever raw bytes were piped in.
+		parsed, err := mgmime.Parse(bytes.NewReader(data))
+		if err != nil {
+			mg.Die(fmt.Errorf("parsing -t message: %v", err))
+		}
+		data, err = mgmime.Render(parsed)
+		if err != nil {
+			mg.Die(fmt.Errorf("re-emitting -t message: %v", err))
+		}
+	}
+	if vflag {
+		parsed, err := mgmime.Parse(bytes.NewReader(data))
+		if err != nil {
+			mg.Die(fmt.Errorf("parsing outgoing message: %v", err))
+		}
+		printParsed(parsed)
+	}
+
+	mg.MailMIME(from, to, bytes.NewReader(data), pgpMiddlewares(to)...)
+}
+
+// printParsed prints a summary of a parsed outgoing message to
+// standard error, for -v to confirm before it is sent.
+func printParsed(msg *mgmime.Message) {
+	fmt.Fprintf(os.Stderr, "text body: %d bytes\n", len(msg.TextBody))
+	if msg.HTMLBody != "" {
+		fmt.Fprintf(os.Stderr, "html body: %d bytes\n", len(msg.HTMLBody))
+	}
+	for _, in := range msg.Inlines {
+		fmt.Fprintf(os.Stderr, "inline: cid=%s %s (%d bytes)\n", in.CID, in.ContentType, len(in.Data))
+	}
+	for _, a := range msg.Attachments {
+		fmt.Fprintf(os.Stderr, "attachment: %s %s (%d bytes)\n", a.Filename, a.ContentType, len(a.Data))
+	}
+}
+
+// pgpMiddlewares builds the MIME middlewares requested by --sign and
+// --encrypt, loading the configured PGP keyring once if either is set.
+func pgpMiddlewares(to []*mail.Address) []mg.MIMEMiddleware {
+	if !signFlag && !encryptFlag {
+		return nil
+	}
+	kr, err := mg.LoadPGPKeyring(mg.PGPKeyFile(), os.Getenv("MAILGUNPGPPASS"))
+	if err != nil {
+		mg.Die(err)
+	}
+	var mws []mg.MIMEMiddleware
+	if signFlag {
+		mws = append(mws, &mg.PGPSign{Keyring: kr})
+	}
+	if encryptFlag {
+		mws = append(mws, &mg.PGPEncrypt{Keyring: kr, To: to})
+	}
+	return mws
 }
 
 func stdinReader() io.Reader {
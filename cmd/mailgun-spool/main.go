@@ -0,0 +1,70 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Mailgun-spool flushes the mailgun outbound spool, retrying delivery
+// of any message that a previous mailgun-sendmail or mailgun-mail
+// invocation could not deliver immediately.
+//
+// Usage:
+//
+//	mailgun-spool [-d dir]
+//
+// Mailgun-spool is meant to be run periodically from cron; it exits
+// immediately, without error, if another instance is already
+// flushing the same spool directory.
+//
+// The options are:
+//
+//	-d dir
+//	    use dir instead of /var/spool/mailgun as the spool directory
+//
+// Configuration
+//
+// Mailgun-spool expects to find an mailgun API domain and authorization key
+// of the form "<domain> api:key-<hexstring>" in the environment variable
+// $MAILGUNKEY, or else in the file $HOME/.mailgun.key,
+// or else in the file /etc/mailgun.key.
+//
+// Diagnostics
+//
+// If the file /var/log/mailgun.log can be opened for writing, mailgun
+// logs its actions, successes, and failures there.
+//
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"rsc.io/getopt"
+	"rsc.io/mailgun/cmd/internal/mg"
+)
+
+func usage() {
+	mg.Logf("invalid command line")
+	fmt.Fprintf(os.Stderr, "usage: mailgun-spool [-d dir]\n")
+	getopt.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	mg.Init()
+
+	var dflag string
+	flag.StringVar(&dflag, "d", "", "use `dir` instead of /var/spool/mailgun as the spool directory")
+
+	flag.Usage = usage
+	getopt.Parse()
+	if flag.NArg() != 0 {
+		usage()
+	}
+	if dflag != "" {
+		mg.SpoolDir = dflag
+	}
+
+	if err := mg.Flush(); err != nil {
+		mg.Die(err)
+	}
+}